@@ -0,0 +1,204 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// accessLogEntry is a single JSON line written per request.
+type accessLogEntry struct {
+	Time            time.Time   `json:"time"`
+	RequestID       string      `json:"request_id"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	Status          int         `json:"status"`
+	DurationSeconds float64     `json:"duration_seconds"`
+	Headers         http.Header `json:"headers"`
+	RequestBody     string      `json:"request_body,omitempty"`
+	ResponseBody    string      `json:"response_body,omitempty"`
+}
+
+// rotatingWriter is a minimal, size-based rotating file writer in the spirit
+// of lumberjack: once the current file passes maxSizeMB it is renamed aside
+// (optionally gzipped) and a fresh file is opened in its place.
+type rotatingWriter struct {
+	mu        sync.Mutex
+	path      string
+	maxBytes  int64
+	gzipRolls bool
+	file      *os.File
+	size      int64
+}
+
+func newRotatingWriter(path string, maxSizeMB int, gzipRolls bool) (*rotatingWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, statErr := file.Stat()
+	size := int64(0)
+	if statErr == nil {
+		size = info.Size()
+	}
+
+	return &rotatingWriter{
+		path:      path,
+		maxBytes:  int64(maxSizeMB) * 1024 * 1024,
+		gzipRolls: gzipRolls,
+		file:      file,
+		size:      size,
+	}, nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.maxBytes > 0 && w.size+int64(len(p)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	rolledPath := fmt.Sprintf("%s.%d", w.path, time.Now().UnixNano())
+	if err := os.Rename(w.path, rolledPath); err != nil {
+		return err
+	}
+
+	if w.gzipRolls {
+		go gzipAndRemove(rolledPath)
+	}
+
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.size = 0
+	return nil
+}
+
+func gzipAndRemove(path string) {
+	in, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		gz.Close()
+		return
+	}
+	if err := gz.Close(); err != nil {
+		return
+	}
+
+	os.Remove(path)
+}
+
+// cappedBuffer collects up to max bytes written to it and silently drops
+// the rest, so logging a request/response body never grows without bound.
+type cappedBuffer struct {
+	max int
+	buf []byte
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if len(c.buf) < c.max {
+		remaining := c.max - len(c.buf)
+		if len(p) < remaining {
+			remaining = len(p)
+		}
+		c.buf = append(c.buf, p[:remaining]...)
+	}
+	return len(p), nil
+}
+
+func (c *cappedBuffer) String() string {
+	return string(c.buf)
+}
+
+// loggingResponseWriter tees the response body into a cappedBuffer while
+// passing every write straight through to the real http.ResponseWriter, so
+// the client still gets a streamed response.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	capture cappedBuffer
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(p []byte) (int, error) {
+	w.capture.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// withAccessLog wraps next with structured request/response logging, writing
+// one JSON line per request to logWriter.
+func withAccessLog(config *WatchdogConfig, logWriter io.Writer, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+
+		requestCapture := cappedBuffer{max: config.logMaxBody}
+		if r.Body != nil {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, &requestCapture), r.Body}
+		}
+
+		lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK, capture: cappedBuffer{max: config.logMaxBody}}
+
+		next(lw, r)
+
+		entry := accessLogEntry{
+			Time:            startTime,
+			RequestID:       r.Header.Get(requestIDHeader),
+			Method:          r.Method,
+			URL:             r.URL.String(),
+			Status:          lw.status,
+			DurationSeconds: time.Since(startTime).Seconds(),
+			Headers:         r.Header,
+			RequestBody:     requestCapture.String(),
+			ResponseBody:    lw.capture.String(),
+		}
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		line = append(line, '\n')
+		logWriter.Write(line)
+	}
+}
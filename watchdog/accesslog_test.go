@@ -0,0 +1,105 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_rotatingWriter_rotatesPastMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	w, err := newRotatingWriter(path, 0, false)
+	if err != nil {
+		t.Fatalf("newRotatingWriter: %s", err)
+	}
+	w.maxBytes = 10 // force a rollover well before a real 1MB-scale size
+
+	if _, err := w.Write([]byte("12345")); err != nil {
+		t.Fatalf("first write: %s", err)
+	}
+	if _, err := w.Write([]byte("678901234")); err != nil {
+		t.Fatalf("second write: %s", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if len(entries) < 2 {
+		t.Fatalf("expected a rolled file alongside the active log, got %d entries", len(entries))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile active log: %s", err)
+	}
+	if string(data) != "678901234" {
+		t.Errorf("active log = %q, want %q", data, "678901234")
+	}
+}
+
+func Test_rotatingWriter_noRotationWhenMaxBytesIsZero(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	w, err := newRotatingWriter(path, 0, false)
+	if err != nil {
+		t.Fatalf("newRotatingWriter: %s", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("write %d: %s", i, err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected no rollover, got %d entries", len(entries))
+	}
+}
+
+func Test_cappedBuffer_truncatesAtMax(t *testing.T) {
+	c := cappedBuffer{max: 5}
+
+	c.Write([]byte("hello world"))
+
+	if got := c.String(); got != "hello" {
+		t.Errorf("String() = %q, want %q", got, "hello")
+	}
+}
+
+func Test_cappedBuffer_acrossMultipleWrites(t *testing.T) {
+	c := cappedBuffer{max: 5}
+
+	c.Write([]byte("he"))
+	c.Write([]byte("llo"))
+	c.Write([]byte(" world"))
+
+	if got := c.String(); got != "hello" {
+		t.Errorf("String() = %q, want %q", got, "hello")
+	}
+}
+
+func Test_cappedBuffer_zeroMaxCapturesNothing(t *testing.T) {
+	c := cappedBuffer{max: 0}
+
+	n, err := c.Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Write returned error: %s", err)
+	}
+	if n != 5 {
+		t.Errorf("Write returned n=%d, want 5 (must report full length written)", n)
+	}
+	if got := c.String(); got != "" {
+		t.Errorf("String() = %q, want empty", got)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import "net/http"
+
+// inflightLimiter bounds the number of concurrent invocations using a
+// buffered channel as a semaphore. A zero-value limiter (size 0) never
+// limits, so max_inflight=0 keeps today's unbounded behaviour.
+type inflightLimiter struct {
+	tokens chan struct{}
+}
+
+func newInflightLimiter(size int) *inflightLimiter {
+	if size <= 0 {
+		return &inflightLimiter{}
+	}
+	return &inflightLimiter{tokens: make(chan struct{}, size)}
+}
+
+// acquire reports whether a slot was obtained. The caller must call release
+// only when acquire returned true.
+func (l *inflightLimiter) acquire() bool {
+	if l.tokens == nil {
+		return true
+	}
+	select {
+	case l.tokens <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *inflightLimiter) release() {
+	if l.tokens == nil {
+		return
+	}
+	<-l.tokens
+}
+
+// withInflightLimit rejects requests with 503 once limiter is saturated,
+// so a burst of invocations can't exhaust PIDs or memory.
+func withInflightLimit(limiter *inflightLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.acquire() {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Concurrent request limit reached, please retry.\n"))
+			return
+		}
+		defer limiter.release()
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import "testing"
+
+func Test_inflightLimiter_zeroSizeIsUnbounded(t *testing.T) {
+	l := newInflightLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !l.acquire() {
+			t.Fatalf("acquire %d failed on unbounded limiter", i)
+		}
+	}
+}
+
+func Test_inflightLimiter_negativeSizeIsUnbounded(t *testing.T) {
+	l := newInflightLimiter(-1)
+	if !l.acquire() {
+		t.Fatal("acquire failed on negative-size limiter")
+	}
+}
+
+func Test_inflightLimiter_blocksAtCapacity(t *testing.T) {
+	l := newInflightLimiter(2)
+
+	if !l.acquire() {
+		t.Fatal("first acquire should succeed")
+	}
+	if !l.acquire() {
+		t.Fatal("second acquire should succeed")
+	}
+	if l.acquire() {
+		t.Fatal("third acquire should fail once limiter is saturated")
+	}
+}
+
+func Test_inflightLimiter_releaseFreesASlot(t *testing.T) {
+	l := newInflightLimiter(1)
+
+	if !l.acquire() {
+		t.Fatal("first acquire should succeed")
+	}
+	if l.acquire() {
+		t.Fatal("second acquire should fail while slot is held")
+	}
+
+	l.release()
+
+	if !l.acquire() {
+		t.Fatal("acquire should succeed again after release")
+	}
+}
+
+func Test_inflightLimiter_releaseOnUnboundedIsNoop(t *testing.T) {
+	l := newInflightLimiter(0)
+	l.release() // must not panic or block
+}
@@ -0,0 +1,112 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/alexellis/faas/watchdog/types"
+)
+
+// WatchdogConfig holds the parsed config for the watchdog process.
+type WatchdogConfig struct {
+	readTimeout    int
+	writeTimeout   int
+	execTimeout    int
+	faasProcess    string
+	debugHeaders   bool
+	contentType    string
+	cgiHeaders     bool
+	writeDebug     bool
+	marshalRequest bool
+	suppressLock   bool
+
+	// mode selects the execution backend: "fork" (default) execs fprocess
+	// per request, "fastcgi" speaks FastCGI to a single long-lived fprocess.
+	mode           string
+	fcgiSocketPath string
+
+	// Structured access logging, see accesslog.go.
+	logEnabled   bool
+	logPath      string
+	logMaxBody   int
+	logMaxSizeMB int
+	logGzip      bool
+
+	// maxInflight caps concurrent invocations; 0 means unbounded.
+	maxInflight int
+	// drainTimeout bounds how long Shutdown waits for in-flight
+	// invocations to finish before the remaining ones are SIGKILLed.
+	drainTimeout int
+
+	// metricsEnabled exposes /metrics in Prometheus format.
+	metricsEnabled bool
+}
+
+// ReadConfig constitutes config from env variables
+type ReadConfig struct {
+}
+
+// Read fetches config from environmental variables.
+func (ReadConfig) Read(hasEnv types.HasEnv) WatchdogConfig {
+	config := WatchdogConfig{
+		writeDebug:     parseBoolValue(hasEnv.Getenv("write_debug")),
+		cgiHeaders:     parseBoolValue(hasEnv.Getenv("cgi_headers")),
+		marshalRequest: parseBoolValue(hasEnv.Getenv("marshal_request")),
+		faasProcess:    hasEnv.Getenv("fprocess"),
+		suppressLock:   parseBoolValue(hasEnv.Getenv("suppress_lock")),
+		contentType:    hasEnv.Getenv("content_type"),
+		mode:           hasEnv.Getenv("mode"),
+		fcgiSocketPath: hasEnv.Getenv("fcgi_socket_path"),
+	}
+
+	if len(config.mode) == 0 {
+		config.mode = "fork"
+	}
+	if len(config.fcgiSocketPath) == 0 {
+		config.fcgiSocketPath = "/tmp/watchdog-fcgi.sock"
+	}
+
+	config.logEnabled = parseBoolValue(hasEnv.Getenv("log_enabled"))
+	config.logPath = hasEnv.Getenv("log_path")
+	if len(config.logPath) == 0 {
+		config.logPath = "/tmp/watchdog-access.log"
+	}
+	config.logMaxBody = parseIntValue(hasEnv.Getenv("log_max_body"), 4096)
+	config.logMaxSizeMB = parseIntValue(hasEnv.Getenv("log_max_size_mb"), 100)
+	config.logGzip = parseBoolValue(hasEnv.Getenv("log_gzip"))
+
+	config.readTimeout = parseIntValue(hasEnv.Getenv("read_timeout"), 10)
+	config.writeTimeout = parseIntValue(hasEnv.Getenv("write_timeout"), 10)
+
+	// exec_timeout bounds the lifetime of a single invocation of fprocess,
+	// independent of the HTTP write timeout. Defaults to writeTimeout so
+	// existing deployments keep their current behaviour.
+	config.execTimeout = parseIntValue(hasEnv.Getenv("exec_timeout"), config.writeTimeout)
+
+	config.maxInflight = parseIntValue(hasEnv.Getenv("max_inflight"), 0)
+	config.drainTimeout = parseIntValue(hasEnv.Getenv("drain_timeout"), 10)
+
+	config.metricsEnabled = parseBoolValue(hasEnv.Getenv("metrics_enabled"))
+
+	return config
+}
+
+func parseBoolValue(val string) bool {
+	if val == "true" {
+		return true
+	}
+	return false
+}
+
+func parseIntValue(val string, fallback int) int {
+	if len(val) > 0 {
+		parsedVal, parseErr := strconv.Atoi(val)
+		if parseErr == nil && parsedVal >= 0 {
+			return parsedVal
+		}
+	}
+
+	return fallback
+}
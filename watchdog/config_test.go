@@ -0,0 +1,49 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import "testing"
+
+func Test_parseIntValue(t *testing.T) {
+	cases := []struct {
+		name     string
+		val      string
+		fallback int
+		want     int
+	}{
+		{"empty uses fallback", "", 10, 10},
+		{"valid value", "30", 10, 30},
+		{"zero is valid", "0", 10, 0},
+		{"negative falls back", "-1", 10, 10},
+		{"non-numeric falls back", "abc", 10, 10},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := parseIntValue(c.val, c.fallback)
+			if got != c.want {
+				t.Errorf("parseIntValue(%q, %d) = %d, want %d", c.val, c.fallback, got, c.want)
+			}
+		})
+	}
+}
+
+func Test_parseBoolValue(t *testing.T) {
+	cases := []struct {
+		val  string
+		want bool
+	}{
+		{"true", true},
+		{"false", false},
+		{"", false},
+		{"True", false},
+		{"1", false},
+	}
+
+	for _, c := range cases {
+		if got := parseBoolValue(c.val); got != c.want {
+			t.Errorf("parseBoolValue(%q) = %v, want %v", c.val, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGI record types and constants, as defined by the FastCGI 1.0
+// specification (section 3 and 8).
+const (
+	fcgiBeginRequest  = 1
+	fcgiEndRequest    = 3
+	fcgiParams        = 4
+	fcgiStdin         = 5
+	fcgiStdout        = 6
+	fcgiStderr        = 7
+	fcgiRoleResponder = 1
+	fcgiKeepConn      = 1
+	fcgiRequestID     = 1
+	fcgiMaxContentLen = 65535
+)
+
+// fcgiPool holds idle connections to the long-lived fprocess so that
+// consecutive requests can reuse a socket instead of reconnecting every time.
+type fcgiPool struct {
+	network string
+	address string
+	mu      sync.Mutex
+	conns   []net.Conn
+}
+
+// newFcgiPool creates a connection pool that dials the given network/address
+// lazily, whenever no idle connection is available.
+func newFcgiPool(network, address string) *fcgiPool {
+	return &fcgiPool{
+		network: network,
+		address: address,
+	}
+}
+
+func (p *fcgiPool) get() (net.Conn, error) {
+	p.mu.Lock()
+	if n := len(p.conns); n > 0 {
+		conn := p.conns[n-1]
+		p.conns = p.conns[:n-1]
+		p.mu.Unlock()
+		return conn, nil
+	}
+	p.mu.Unlock()
+
+	return net.Dial(p.network, p.address)
+}
+
+func (p *fcgiPool) put(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns = append(p.conns, conn)
+}
+
+type fcgiHeader struct {
+	Version       uint8
+	Type          uint8
+	RequestID     uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// writeFcgiRecord writes content as one or more FastCGI records, splitting
+// on fcgiMaxContentLen. A nil/empty content still produces a single
+// zero-length record, which is how PARAMS and STDIN streams are terminated.
+func writeFcgiRecord(w io.Writer, recType uint8, requestID uint16, content []byte) error {
+	for {
+		chunk := content
+		if len(chunk) > fcgiMaxContentLen {
+			chunk = chunk[:fcgiMaxContentLen]
+		}
+		content = content[len(chunk):]
+
+		header := fcgiHeader{
+			Version:       1,
+			Type:          recType,
+			RequestID:     requestID,
+			ContentLength: uint16(len(chunk)),
+		}
+		if err := binary.Write(w, binary.BigEndian, header); err != nil {
+			return err
+		}
+		if len(chunk) > 0 {
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+		}
+
+		if len(content) == 0 {
+			return nil
+		}
+	}
+}
+
+// encodeFcgiNameValue encodes a single FastCGI name-value pair, using the
+// short (1-byte) length form for lengths below 128 and the long (4-byte)
+// form otherwise.
+func encodeFcgiNameValue(buf *bufio.Writer, name, value string) {
+	writeFcgiLen(buf, len(name))
+	writeFcgiLen(buf, len(value))
+	buf.WriteString(name)
+	buf.WriteString(value)
+}
+
+func writeFcgiLen(buf *bufio.Writer, l int) {
+	if l < 128 {
+		buf.WriteByte(byte(l))
+		return
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(l)|1<<31)
+	buf.Write(b[:])
+}
+
+// doFcgiRequest sends a single FastCGI request over a pooled connection and
+// streams the responder's stdout back to w. timeout bounds the entire
+// exchange, so a stuck or slow responder can't hang the request forever -
+// the same guarantee exec_timeout gives fork mode.
+func doFcgiRequest(pool *fcgiPool, envs []string, requestBody []byte, w http.ResponseWriter, timeout time.Duration) error {
+	conn, err := pool.get()
+	if err != nil {
+		return fmt.Errorf("unable to connect to fastcgi responder: %s", err.Error())
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	begin := make([]byte, 8)
+	binary.BigEndian.PutUint16(begin[0:2], fcgiRoleResponder)
+	begin[2] = fcgiKeepConn
+	if err := writeFcgiRecord(conn, fcgiBeginRequest, fcgiRequestID, begin); err != nil {
+		conn.Close()
+		return err
+	}
+
+	var params bytes.Buffer
+	bw := bufio.NewWriter(&params)
+	for _, kv := range envs {
+		name, value := splitEnv(kv)
+		encodeFcgiNameValue(bw, name, value)
+	}
+	bw.Flush()
+
+	if err := writeFcgiRecord(conn, fcgiParams, fcgiRequestID, params.Bytes()); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := writeFcgiRecord(conn, fcgiParams, fcgiRequestID, nil); err != nil {
+		conn.Close()
+		return err
+	}
+
+	if err := writeFcgiRecord(conn, fcgiStdin, fcgiRequestID, requestBody); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := writeFcgiRecord(conn, fcgiStdin, fcgiRequestID, nil); err != nil {
+		conn.Close()
+		return err
+	}
+
+	// A real FastCGI responder (e.g. net/http/fcgi, or anything built on
+	// net/http/cgi's conventions) writes a CGI-style header preamble on
+	// FCGI_STDOUT before the body: a "Status: <code> <text>" line, zero or
+	// more "Key: Value" header lines, then a blank line. That preamble
+	// isn't part of the body, so it has to be parsed out and turned into
+	// the real w.WriteHeader/w.Header() rather than forwarded as-is.
+	stdoutReader, stdoutWriter := io.Pipe()
+	recordsDone := make(chan error, 1)
+	go func() {
+		recordsDone <- readFcgiRecords(conn, stdoutWriter)
+	}()
+
+	cgiErr := writeCgiResponse(stdoutReader, w)
+	// Closing the read side unblocks readFcgiRecords if writeCgiResponse
+	// stopped reading early, so the wait below can't hang.
+	stdoutReader.Close()
+	recordsErr := <-recordsDone
+
+	conn.SetDeadline(time.Time{})
+	if cgiErr != nil {
+		conn.Close()
+		return cgiErr
+	}
+	if recordsErr != nil {
+		conn.Close()
+		return recordsErr
+	}
+
+	pool.put(conn)
+	return nil
+}
+
+// readFcgiRecords reads FastCGI records from conn until fcgiEndRequest,
+// copying FCGI_STDOUT content to stdout and FCGI_STDERR content to the
+// watchdog's own stderr. stdout is always closed before returning, with any
+// error propagated to whatever is reading from it.
+func readFcgiRecords(conn net.Conn, stdout *io.PipeWriter) error {
+	for {
+		var header fcgiHeader
+		if err := binary.Read(conn, binary.BigEndian, &header); err != nil {
+			stdout.CloseWithError(err)
+			return err
+		}
+
+		content := make([]byte, header.ContentLength)
+		if _, err := io.ReadFull(conn, content); err != nil {
+			stdout.CloseWithError(err)
+			return err
+		}
+		if header.PaddingLength > 0 {
+			io.CopyN(ioutil.Discard, conn, int64(header.PaddingLength))
+		}
+
+		switch header.Type {
+		case fcgiStdout:
+			if len(content) == 0 {
+				continue
+			}
+			if _, err := stdout.Write(content); err != nil {
+				stdout.CloseWithError(err)
+				return err
+			}
+		case fcgiStderr:
+			os.Stderr.Write(content)
+		case fcgiEndRequest:
+			stdout.Close()
+			return nil
+		}
+	}
+}
+
+// writeCgiResponse parses the CGI header preamble (a "Status" line, zero or
+// more headers, then a blank line) from r, applies it to w, and copies the
+// remainder of r to w as the body.
+func writeCgiResponse(r io.Reader, w http.ResponseWriter) error {
+	br := bufio.NewReader(r)
+	tp := textproto.NewReader(br)
+
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("reading CGI header preamble: %s", err.Error())
+	}
+
+	status := http.StatusOK
+	if statusLine := mimeHeader.Get("Status"); len(statusLine) > 0 {
+		mimeHeader.Del("Status")
+		if code, parseErr := strconv.Atoi(strings.Fields(statusLine)[0]); parseErr == nil {
+			status = code
+		}
+	}
+
+	// Set() on the first value of each header so a responder-supplied
+	// Content-Type (or any other header) replaces dispatchRequest's
+	// default instead of being appended alongside it; Add() for any
+	// further values of the same key (e.g. multiple Set-Cookie headers).
+	header := w.Header()
+	for key, values := range mimeHeader {
+		for i, value := range values {
+			if i == 0 {
+				header.Set(key, value)
+			} else {
+				header.Add(key, value)
+			}
+		}
+	}
+
+	w.WriteHeader(status)
+	_, err = io.Copy(w, br)
+	return err
+}
+
+func splitEnv(kv string) (string, string) {
+	for i := 0; i < len(kv); i++ {
+		if kv[i] == '=' {
+			return kv[:i], kv[i+1:]
+		}
+	}
+	return kv, ""
+}
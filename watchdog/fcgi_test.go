@@ -0,0 +1,239 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_writeFcgiRecord_roundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	content := []byte("hello world")
+
+	if err := writeFcgiRecord(&buf, fcgiStdin, fcgiRequestID, content); err != nil {
+		t.Fatalf("writeFcgiRecord: %s", err)
+	}
+
+	var header fcgiHeader
+	if err := binary.Read(&buf, binary.BigEndian, &header); err != nil {
+		t.Fatalf("reading header: %s", err)
+	}
+	if header.Type != fcgiStdin {
+		t.Errorf("Type = %d, want %d", header.Type, fcgiStdin)
+	}
+	if header.RequestID != fcgiRequestID {
+		t.Errorf("RequestID = %d, want %d", header.RequestID, fcgiRequestID)
+	}
+	if int(header.ContentLength) != len(content) {
+		t.Errorf("ContentLength = %d, want %d", header.ContentLength, len(content))
+	}
+
+	got := make([]byte, header.ContentLength)
+	if _, err := io.ReadFull(&buf, got); err != nil {
+		t.Fatalf("reading content: %s", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("content = %q, want %q", got, content)
+	}
+}
+
+func Test_writeFcgiRecord_splitsOversizedContent(t *testing.T) {
+	var buf bytes.Buffer
+	content := bytes.Repeat([]byte("a"), fcgiMaxContentLen+100)
+
+	if err := writeFcgiRecord(&buf, fcgiStdin, fcgiRequestID, content); err != nil {
+		t.Fatalf("writeFcgiRecord: %s", err)
+	}
+
+	var first fcgiHeader
+	if err := binary.Read(&buf, binary.BigEndian, &first); err != nil {
+		t.Fatalf("reading first header: %s", err)
+	}
+	if int(first.ContentLength) != fcgiMaxContentLen {
+		t.Errorf("first ContentLength = %d, want %d", first.ContentLength, fcgiMaxContentLen)
+	}
+	io.CopyN(io.Discard, &buf, int64(first.ContentLength))
+
+	var second fcgiHeader
+	if err := binary.Read(&buf, binary.BigEndian, &second); err != nil {
+		t.Fatalf("reading second header: %s", err)
+	}
+	if int(second.ContentLength) != 100 {
+		t.Errorf("second ContentLength = %d, want %d", second.ContentLength, 100)
+	}
+}
+
+func Test_writeFcgiRecord_emptyContentProducesTerminator(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFcgiRecord(&buf, fcgiParams, fcgiRequestID, nil); err != nil {
+		t.Fatalf("writeFcgiRecord: %s", err)
+	}
+
+	var header fcgiHeader
+	if err := binary.Read(&buf, binary.BigEndian, &header); err != nil {
+		t.Fatalf("reading header: %s", err)
+	}
+	if header.ContentLength != 0 {
+		t.Errorf("ContentLength = %d, want 0", header.ContentLength)
+	}
+}
+
+func Test_encodeFcgiNameValue_shortForm(t *testing.T) {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	encodeFcgiNameValue(bw, "REQUEST_METHOD", "GET")
+	bw.Flush()
+
+	b := buf.Bytes()
+	if b[0] != byte(len("REQUEST_METHOD")) || b[1] != byte(len("GET")) {
+		t.Fatalf("unexpected length prefixes: %v", b[:2])
+	}
+
+	name := string(b[2 : 2+len("REQUEST_METHOD")])
+	value := string(b[2+len("REQUEST_METHOD") : 2+len("REQUEST_METHOD")+len("GET")])
+	if name != "REQUEST_METHOD" || value != "GET" {
+		t.Errorf("got name=%q value=%q", name, value)
+	}
+}
+
+func Test_encodeFcgiNameValue_longForm(t *testing.T) {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	longValue := string(bytes.Repeat([]byte("x"), 200))
+	encodeFcgiNameValue(bw, "BODY", longValue)
+	bw.Flush()
+
+	b := buf.Bytes()
+	// "BODY" is short enough for the 1-byte length form; the 200-byte value
+	// needs the 4-byte long form with the high bit set.
+	if b[0] != byte(len("BODY")) {
+		t.Fatalf("name length = %d, want %d", b[0], len("BODY"))
+	}
+	valueLenBytes := b[1:5]
+	if valueLenBytes[0]&0x80 == 0 {
+		t.Fatalf("expected high bit set for long form, got %v", valueLenBytes)
+	}
+	valueLen := binary.BigEndian.Uint32(valueLenBytes) &^ (1 << 31)
+	if valueLen != uint32(len(longValue)) {
+		t.Errorf("valueLen = %d, want %d", valueLen, len(longValue))
+	}
+}
+
+// startFcgiResponder runs a real net/http/fcgi.Serve responder on a local
+// TCP listener using handler, so doFcgiRequest can be exercised against the
+// same CGI header preamble format the standard library emits.
+func startFcgiResponder(t *testing.T, handler http.HandlerFunc) *fcgiPool {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+
+	go fcgi.Serve(listener, handler)
+	t.Cleanup(func() { listener.Close() })
+
+	return newFcgiPool("tcp", listener.Addr().String())
+}
+
+func Test_doFcgiRequest_parsesCGIHeaderPreamble(t *testing.T) {
+	pool := startFcgiResponder(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Custom", "value")
+		w.Write([]byte("hello from fcgi"))
+	})
+
+	envs := []string{"REQUEST_METHOD=GET", "SERVER_PROTOCOL=HTTP/1.1"}
+
+	rec := httptest.NewRecorder()
+	if err := doFcgiRequest(pool, envs, nil, rec, time.Second); err != nil {
+		t.Fatalf("doFcgiRequest: %s", err)
+	}
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Body.String(); got != "hello from fcgi" {
+		t.Errorf("body = %q, want %q (CGI header preamble leaked into body)", got, "hello from fcgi")
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Content-Type = %q, want %q", got, "text/plain")
+	}
+	if got := rec.Header().Get("X-Custom"); got != "value" {
+		t.Errorf("X-Custom = %q, want %q", got, "value")
+	}
+}
+
+func Test_doFcgiRequest_responderContentTypeReplacesCallerDefault(t *testing.T) {
+	pool := startFcgiResponder(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	})
+
+	envs := []string{"REQUEST_METHOD=GET", "SERVER_PROTOCOL=HTTP/1.1"}
+
+	rec := httptest.NewRecorder()
+	// Simulate dispatchRequest's default Content-Type, set before the
+	// backend runs, the same way a caller's Content-Type is applied today.
+	rec.Header().Set("Content-Type", "text/plain")
+
+	if err := doFcgiRequest(pool, envs, nil, rec, time.Second); err != nil {
+		t.Fatalf("doFcgiRequest: %s", err)
+	}
+
+	got := rec.Header().Values("Content-Type")
+	if len(got) != 1 || got[0] != "application/json" {
+		t.Errorf("Content-Type = %v, want exactly [\"application/json\"]", got)
+	}
+}
+
+func Test_doFcgiRequest_propagatesNon200Status(t *testing.T) {
+	pool := startFcgiResponder(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("boom"))
+	})
+
+	envs := []string{"REQUEST_METHOD=GET", "SERVER_PROTOCOL=HTTP/1.1"}
+
+	rec := httptest.NewRecorder()
+	if err := doFcgiRequest(pool, envs, nil, rec, time.Second); err != nil {
+		t.Fatalf("doFcgiRequest: %s", err)
+	}
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if got := rec.Body.String(); got != "boom" {
+		t.Errorf("body = %q, want %q", got, "boom")
+	}
+}
+
+func Test_splitEnv(t *testing.T) {
+	cases := []struct {
+		kv        string
+		wantName  string
+		wantValue string
+	}{
+		{"FOO=bar", "FOO", "bar"},
+		{"FOO=bar=baz", "FOO", "bar=baz"},
+		{"FOO=", "FOO", ""},
+		{"FOO", "FOO", ""},
+	}
+
+	for _, c := range cases {
+		name, value := splitEnv(c.kv)
+		if name != c.wantName || value != c.wantValue {
+			t.Errorf("splitEnv(%q) = (%q, %q), want (%q, %q)", c.kv, name, value, c.wantName, c.wantValue)
+		}
+	}
+}
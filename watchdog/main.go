@@ -4,17 +4,27 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
 	"github.com/alexellis/faas/watchdog/types"
 )
 
@@ -44,7 +54,20 @@ func debugHeaders(source *http.Header, direction string) {
 	}
 }
 
-func pipeRequest(config *WatchdogConfig, w http.ResponseWriter, r *http.Request, method string, hasBody bool) {
+// shutdownSignal lets pipeRequest observe the shutdown drain grace period
+// expiring, so in-flight fprocess invocations get SIGKILLed even if their
+// own exec_timeout hasn't elapsed yet - see main()'s SIGTERM handler.
+type shutdownSignal struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newShutdownSignal() *shutdownSignal {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &shutdownSignal{ctx: ctx, cancel: cancel}
+}
+
+func pipeRequest(config *WatchdogConfig, shutdown *shutdownSignal, w http.ResponseWriter, r *http.Request, method string, hasBody bool, requestID string) error {
 	startTime := time.Now()
 
 	parts := strings.Split(config.faasProcess, " ")
@@ -53,7 +76,31 @@ func pipeRequest(config *WatchdogConfig, w http.ResponseWriter, r *http.Request,
 		debugHeaders(&r.Header, "in")
 	}
 
-	targetCmd := exec.Command(parts[0], parts[1:]...)
+	// marshal_request needs the whole body buffered up front to build the CGI
+	// envelope (see buildFunctionInput), so do that now, before anything is
+	// written to the client: a malformed body can still be reported as a 400
+	// instead of silently handing the function an empty stdin behind an
+	// already-written 200.
+	var marshalledBody []byte
+	if hasBody && config.marshalRequest {
+		body, buildInputErr := buildFunctionInput(config, r)
+		if buildInputErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(buildInputErr.Error()))
+			return buildInputErr
+		}
+		marshalledBody = body
+	}
+
+	execTimeout := time.Duration(config.execTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(shutdown.ctx, execTimeout)
+	defer cancel()
+
+	targetCmd := exec.CommandContext(ctx, parts[0], parts[1:]...)
+
+	// Run fprocess in its own process group so a timeout can kill any
+	// children it has spawned, not just the immediate process.
+	targetCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
 	envs := getAdditionalEnvs(config, r, method)
 	if len(envs) > 0 {
@@ -61,82 +108,105 @@ func pipeRequest(config *WatchdogConfig, w http.ResponseWriter, r *http.Request,
 
 	}
 
-	writer, _ := targetCmd.StdinPipe()
-
-	var out []byte
-	var err error
-	var requestBody []byte
-
-	var wg sync.WaitGroup
+	stdin, stdinErr := targetCmd.StdinPipe()
+	if stdinErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(stdinErr.Error()))
+		return stdinErr
+	}
 
-	wgCount := 2
-	if hasBody == false {
-		wgCount = 1
+	stdout, stdoutErr := targetCmd.StdoutPipe()
+	if stdoutErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(stdoutErr.Error()))
+		return stdoutErr
 	}
 
-	if hasBody {
-		var buildInputErr error
-		requestBody, buildInputErr = buildFunctionInput(config, r)
-		if buildInputErr != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(buildInputErr.Error()))
-			return
-		}
+	if startErr := targetCmd.Start(); startErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(startErr.Error()))
+		return startErr
 	}
 
-	wg.Add(wgCount)
+	// Kill the process group the moment ctx is done - either because
+	// exec_timeout fired or because shutdown's drain grace period expired -
+	// rather than waiting for targetCmd.Wait() to return: Wait only returns
+	// once stdout reaches EOF, which an orphaned grandchild holding stdout
+	// open can block forever, so killing late can never actually unblock
+	// it. Killing immediately also means the pid hasn't had a chance to be
+	// recycled by the kernel for something unrelated.
+	timeoutWatchDone := make(chan struct{})
+	defer close(timeoutWatchDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(targetCmd)
+		case <-timeoutWatchDone:
+		}
+	}()
 
-	// Only write body if this is appropriate for the method.
-	if hasBody {
-		// Write to pipe in separate go-routine to prevent blocking
-		go func() {
-			defer wg.Done()
-			writer.Write(requestBody)
-			writer.Close()
-		}()
-	}
+	var wg sync.WaitGroup
+	wg.Add(1)
 
+	// Stream the request body straight into the child's stdin rather than
+	// buffering it, so large payloads don't have to fit in memory twice.
+	// marshal_request is the exception, since its envelope was already
+	// built above.
 	go func() {
 		defer wg.Done()
-		out, err = targetCmd.CombinedOutput()
+		if hasBody {
+			if config.marshalRequest {
+				stdin.Write(marshalledBody)
+			} else {
+				io.Copy(stdin, r.Body)
+			}
+		}
+		stdin.Close()
 	}()
 
+	// Copy stdout back to the caller incrementally instead of waiting for
+	// the process to exit, so functions can stream chunked responses.
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, stdout)
+
 	wg.Wait()
+	waitErr := targetCmd.Wait()
 
-	if err != nil {
+	timedOut := ctx.Err() == context.DeadlineExceeded
+	if timedOut {
 		if config.writeDebug == true {
-			log.Println(targetCmd, err)
+			log.Printf("%sTimed out waiting on %s after %s\n", requestLogPrefix(requestID), targetCmd.Path, execTimeout)
 		}
-		w.WriteHeader(http.StatusInternalServerError)
-		response := bytes.NewBufferString(err.Error())
-		w.Write(response.Bytes())
-		return
-	}
-	if config.writeDebug == true {
-		os.Stdout.Write(out)
-	}
-
-	if len(config.contentType) > 0 {
-		w.Header().Set("Content-Type", config.contentType)
-	} else {
-
-		// Match content-type of caller if no override specified.
-		clientContentType := r.Header.Get("Content-Type")
-		if len(clientContentType) > 0 {
-			w.Header().Set("Content-Type", clientContentType)
+	} else if waitErr != nil {
+		if config.writeDebug == true {
+			log.Println(requestLogPrefix(requestID), targetCmd, waitErr)
 		}
 	}
 
 	execTime := time.Since(startTime).Seconds()
 	w.Header().Set("X-Duration-Seconds", fmt.Sprintf("%f", execTime))
 
-	w.WriteHeader(200)
-	w.Write(out)
-
 	if config.debugHeaders {
 		header := w.Header()
 		debugHeaders(&header, "out")
 	}
+
+	if timedOut {
+		return context.DeadlineExceeded
+	}
+	return waitErr
+}
+
+// killProcessGroup sends SIGKILL to the process group of cmd so that any
+// children the invoked function forked are also reaped, rather than being
+// left as orphans when the parent is killed on timeout.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if killErr := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); killErr != nil {
+		log.Printf("Error killing process group for pid %d: %s\n", cmd.Process.Pid, killErr.Error())
+	}
 }
 
 func getAdditionalEnvs(config *WatchdogConfig, r *http.Request, method string) []string {
@@ -153,24 +223,36 @@ func getAdditionalEnvs(config *WatchdogConfig, r *http.Request, method string) [
 		if len(r.URL.RawQuery) > 0 {
 			envs = append(envs, fmt.Sprintf("Http_Query=%s", r.URL.RawQuery))
 		}
+
+		if requestID := r.Header.Get(requestIDHeader); len(requestID) > 0 {
+			envs = append(envs, fmt.Sprintf("Http_X_Request_Id=%s", requestID))
+		}
 	}
 
 	return envs
 }
 
-func makeRequestHandler(config *WatchdogConfig) func(http.ResponseWriter, *http.Request) {
+func requestLogPrefix(requestID string) string {
+	return fmt.Sprintf("[%s] ", requestID)
+}
+
+func makeRequestHandler(config *WatchdogConfig, pool *fcgiPool, sp *streamProcess, shutdown *shutdownSignal) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := requestIDFor(r)
+		r.Header.Set(requestIDHeader, requestID)
+		w.Header().Set(requestIDHeader, requestID)
+
 		switch r.Method {
 		case
 			"POST",
 			"PUT",
 			"DELETE",
 			"UPDATE":
-			pipeRequest(config, w, r, r.Method, true)
+			dispatchRequest(config, pool, sp, shutdown, w, r, r.Method, true, requestID)
 			break
 		case
 			"GET":
-			pipeRequest(config, w, r, r.Method, false)
+			dispatchRequest(config, pool, sp, shutdown, w, r, r.Method, false, requestID)
 			break
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -179,6 +261,127 @@ func makeRequestHandler(config *WatchdogConfig) func(http.ResponseWriter, *http.
 	}
 }
 
+// dispatchRequest routes to the configured execution backend: pipeRequest
+// forks fprocess per-call, while fastcgi mode reuses the long-lived
+// responder started in main() via a pooled connection.
+func dispatchRequest(config *WatchdogConfig, pool *fcgiPool, sp *streamProcess, shutdown *shutdownSignal, w http.ResponseWriter, r *http.Request, method string, hasBody bool, requestID string) {
+	execStart := recordExecStart()
+	failed := false
+	defer func() {
+		recordExecEnd(execStart, failed)
+	}()
+
+	// content_type/Content-Type matching applies to every backend, not just
+	// fork mode, so it's handled once here rather than in each of
+	// pipeRequest/doFcgiRequest/doStreamRequest.
+	if len(config.contentType) > 0 {
+		w.Header().Set("Content-Type", config.contentType)
+	} else if clientContentType := r.Header.Get("Content-Type"); len(clientContentType) > 0 {
+		// Match content-type of caller if no override specified.
+		w.Header().Set("Content-Type", clientContentType)
+	}
+
+	execTimeout := time.Duration(config.execTimeout) * time.Second
+
+	if config.mode == "fastcgi" {
+		var requestBody []byte
+		if hasBody {
+			body, buildErr := buildFunctionInput(config, r)
+			if buildErr != nil {
+				failed = true
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(buildErr.Error()))
+				return
+			}
+			requestBody = body
+		}
+		envs := getAdditionalEnvs(config, r, method)
+		if err := doFcgiRequest(pool, envs, requestBody, w, execTimeout); err != nil {
+			failed = true
+			if config.writeDebug == true {
+				log.Println(requestLogPrefix(requestID) + err.Error())
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+		}
+		return
+	}
+
+	if config.mode == "stream" {
+		// Unlike fork/fastcgi mode, stream mode's fprocess is started once
+		// in main() and never restarted per request, so getAdditionalEnvs
+		// (cgi_headers, Http_X_Request_Id, ...) has nothing to attach to -
+		// there's no per-request process to set env vars on. marshal_request
+		// is the supported way to get headers, including X-Request-Id, to a
+		// stream-mode function: buildFunctionInput wraps them into the body
+		// envelope below. With marshal_request=false, stream mode has no
+		// per-request correlation channel; that's a known limitation.
+		requestBody, buildErr := buildFunctionInput(config, r)
+		if buildErr != nil {
+			failed = true
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(buildErr.Error()))
+			return
+		}
+		if err := doStreamRequest(sp, requestBody, w, execTimeout); err != nil {
+			failed = true
+			if config.writeDebug == true {
+				log.Println(requestLogPrefix(requestID) + err.Error())
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+		}
+		return
+	}
+
+	if execErr := pipeRequest(config, shutdown, w, r, method, hasBody, requestID); execErr != nil {
+		failed = true
+	}
+}
+
+// startFastCGIProcess launches fprocess once, handing it a listening Unix
+// socket as fd 0 (the same convention spawn-fcgi uses), and returns a pool
+// the request handler can dial to multiplex requests over that socket.
+func startFastCGIProcess(config *WatchdogConfig) (*fcgiPool, error) {
+	os.Remove(config.fcgiSocketPath)
+
+	listener, err := net.Listen("unix", config.fcgiSocketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	unixListener, ok := listener.(*net.UnixListener)
+	if !ok {
+		listener.Close()
+		return nil, fmt.Errorf("fcgi_socket_path must be a unix socket")
+	}
+
+	socketFile, fileErr := unixListener.File()
+	listener.Close()
+	if fileErr != nil {
+		return nil, fileErr
+	}
+	defer socketFile.Close()
+
+	parts := strings.Split(config.faasProcess, " ")
+	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd.Stdin = socketFile
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if startErr := cmd.Start(); startErr != nil {
+		return nil, startErr
+	}
+
+	go func() {
+		if waitErr := cmd.Wait(); waitErr != nil {
+			log.Printf("fastcgi responder %s exited: %s\n", config.faasProcess, waitErr.Error())
+		}
+	}()
+
+	return newFcgiPool("unix", config.fcgiSocketPath), nil
+}
+
 func main() {
 	osEnv := types.OsEnv{}
 	readConfig := ReadConfig{}
@@ -199,7 +402,64 @@ func main() {
 		MaxHeaderBytes: 1 << 20, // Max header of 1MB
 	}
 
-	http.HandleFunc("/", makeRequestHandler(&config))
+	var pool *fcgiPool
+	var sp *streamProcess
+	switch config.mode {
+	case "fastcgi":
+		startedPool, startErr := startFastCGIProcess(&config)
+		if startErr != nil {
+			log.Panicln(startErr)
+		}
+		pool = startedPool
+	case "stream":
+		startedProcess, startErr := startStreamProcess(&config)
+		if startErr != nil {
+			log.Panicln(startErr)
+		}
+		sp = startedProcess
+	}
+
+	shutdown := newShutdownSignal()
+	handler := makeRequestHandler(&config, pool, sp, shutdown)
+
+	// withInflightLimit wraps the innermost handler so its 503 rejections
+	// still pass back out through access logging and metrics, instead of
+	// short-circuiting before either sees the request - otherwise a
+	// saturated watchdog's throttling would be invisible to both.
+	limiter := newInflightLimiter(config.maxInflight)
+	handler = withInflightLimit(limiter, handler)
+
+	if config.logEnabled {
+		logWriter, logErr := newRotatingWriter(config.logPath, config.logMaxSizeMB, config.logGzip)
+		if logErr != nil {
+			log.Panicln(logErr)
+		}
+		handler = withAccessLog(&config, logWriter, handler)
+	}
+	if config.metricsEnabled {
+		handler = withMetrics(handler)
+		http.Handle("/metrics", promhttp.Handler())
+	}
+
+	http.HandleFunc("/", handler)
+
+	var shuttingDown int32
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&shuttingDown) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("shutting down\n"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK\n"))
+	})
+
+	// main() serves plain-text HTTP (ListenAndServe, no TLS), so
+	// http2.ConfigureServer alone would never be reached - it only upgrades
+	// connections negotiated over TLS. Wrap the handler in h2c instead so a
+	// single cleartext connection can still carry the sequence of framed
+	// messages used by mode=stream, rather than one request per connection.
+	s.Handler = h2c.NewHandler(http.DefaultServeMux, &http2.Server{})
 
 	if config.suppressLock == false {
 		path := "/tmp/.lock"
@@ -209,5 +469,36 @@ func main() {
 			log.Panicf("Cannot write %s. To disable lock-file set env suppress_lock=true.\n Error: %s.\n", path, writeErr.Error())
 		}
 	}
-	log.Fatal(s.ListenAndServe())
+
+	// On SIGTERM/SIGINT (e.g. a Kubernetes pod being terminated), flip
+	// /healthz to failing so the pod stops receiving traffic, then let
+	// Shutdown close the listener and drain in-flight invocations for up to
+	// drainTimeout. Shutdown only waits - it never force-terminates
+	// a handler still running past drainTimeout, so once it reports the
+	// grace period elapsed we cancel shutdown.ctx ourselves, which
+	// pipeRequest's exec context is derived from, to SIGKILL whatever
+	// fprocess invocations are still in flight. ListenAndServe returns as
+	// soon as Shutdown starts, so main waits on shutdownDone before exiting.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-sigChan
+		atomic.StoreInt32(&shuttingDown, 1)
+		log.Println("Received shutdown signal, draining in-flight requests...")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.drainTimeout)*time.Second)
+		defer cancel()
+		if shutdownErr := s.Shutdown(ctx); shutdownErr != nil {
+			log.Println("Graceful shutdown failed:", shutdownErr.Error())
+			log.Println("Drain timeout exceeded, force-killing in-flight invocations...")
+			shutdown.cancel()
+		}
+	}()
+
+	if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 }
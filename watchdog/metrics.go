@@ -0,0 +1,105 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics for invocations, registered unconditionally but only
+// exposed on /metrics when metrics_enabled is set - see main().
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Total number of HTTP requests processed by the watchdog, by method and status code.",
+		},
+		[]string{"method", "code"},
+	)
+
+	httpRequestDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "http_request_duration_seconds",
+			Help: "HTTP request duration in seconds; the source of truth for latency, superseding the X-Duration-Seconds response header.",
+		},
+	)
+
+	functionExecDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "function_exec_duration_seconds",
+			Help: "Time spent executing fprocess for a single invocation.",
+		},
+	)
+
+	functionExecFailuresTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "function_exec_failures_total",
+			Help: "Total number of fprocess invocations that failed or timed out.",
+		},
+	)
+
+	functionInflight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "function_inflight",
+			Help: "Number of fprocess invocations currently in progress.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		functionExecDuration,
+		functionExecFailuresTotal,
+		functionInflight,
+	)
+}
+
+// statusRecorder captures the status code written by the wrapped handler so
+// it can be reported as a Prometheus label after the handler returns.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// withMetrics records http_requests_total and http_request_duration_seconds
+// for every request that reaches next.
+func withMetrics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next(rec, r)
+
+		httpRequestDuration.Observe(time.Since(startTime).Seconds())
+		httpRequestsTotal.WithLabelValues(r.Method, strconv.Itoa(rec.status)).Inc()
+	}
+}
+
+// recordExecStart and recordExecEnd report function-level exec latency and
+// in-flight count around a single fprocess invocation; call recordExecStart
+// before invoking fprocess and recordExecEnd with its returned time once it
+// has finished, passing whether it failed.
+func recordExecStart() time.Time {
+	functionInflight.Inc()
+	return time.Now()
+}
+
+func recordExecEnd(startTime time.Time, failed bool) {
+	functionInflight.Dec()
+	functionExecDuration.Observe(time.Since(startTime).Seconds())
+	if failed {
+		functionExecFailuresTotal.Inc()
+	}
+}
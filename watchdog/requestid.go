@@ -0,0 +1,55 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// requestIDHeader is both the inbound header callers may set to correlate a
+// request across services, and the outbound header the watchdog echoes it
+// on, so a single ID can be traced through gateway, watchdog and function.
+const requestIDHeader = "X-Request-Id"
+
+var requestIDCounter uint64
+
+// machineID identifies this instance of the watchdog for request-ID
+// generation. It's read once at startup since it never changes at runtime.
+var machineID = readMachineID()
+
+func readMachineID() string {
+	if data, err := ioutil.ReadFile("/etc/machine-id"); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "watchdog"
+}
+
+// nextRequestID returns a new identifier built from the machine ID, the
+// watchdog's PID and a monotonic counter, so IDs are unique across
+// concurrent requests within one process without needing a random source.
+// The counter starts again at 1 on restart, so a restarted watchdog that
+// gets the same PID repeats earlier IDs.
+func nextRequestID() string {
+	count := atomic.AddUint64(&requestIDCounter, 1)
+	raw := fmt.Sprintf("%s-%d-%d", machineID, os.Getpid(), count)
+	return hex.EncodeToString([]byte(raw))
+}
+
+// requestIDFor reads X-Request-Id from the incoming request, or generates
+// one if the caller didn't supply it.
+func requestIDFor(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); len(id) > 0 {
+		return id
+	}
+	return nextRequestID()
+}
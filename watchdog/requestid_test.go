@@ -0,0 +1,66 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_nextRequestID_isHexEncoded(t *testing.T) {
+	id := nextRequestID()
+
+	if _, err := hex.DecodeString(id); err != nil {
+		t.Fatalf("nextRequestID() = %q is not valid hex: %s", id, err)
+	}
+}
+
+func Test_nextRequestID_isUniquePerCall(t *testing.T) {
+	first := nextRequestID()
+	second := nextRequestID()
+
+	if first == second {
+		t.Errorf("expected distinct IDs, got %q twice", first)
+	}
+}
+
+func Test_nextRequestID_decodesToMachineIDAndPid(t *testing.T) {
+	id := nextRequestID()
+
+	raw, err := hex.DecodeString(id)
+	if err != nil {
+		t.Fatalf("hex.DecodeString: %s", err)
+	}
+
+	wantPrefix := fmt.Sprintf("%s-%d-", machineID, os.Getpid())
+	if !strings.HasPrefix(string(raw), wantPrefix) {
+		t.Errorf("decoded ID %q doesn't start with machineID and pid %q", raw, wantPrefix)
+	}
+}
+
+func Test_requestIDFor_echoesCallerSuppliedID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(requestIDHeader, "caller-supplied-id")
+
+	if got := requestIDFor(r); got != "caller-supplied-id" {
+		t.Errorf("requestIDFor() = %q, want %q", got, "caller-supplied-id")
+	}
+}
+
+func Test_requestIDFor_generatesWhenMissing(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	id := requestIDFor(r)
+	if len(id) == 0 {
+		t.Fatal("requestIDFor() returned empty ID when caller supplied none")
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		t.Errorf("generated ID %q is not valid hex: %s", id, err)
+	}
+}
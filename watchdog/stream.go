@@ -0,0 +1,191 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamProcess manages a single long-lived fprocess that speaks the
+// watchdog's length-prefixed framing protocol over its own stdin/stdout.
+// mode=stream drives many logical request/response exchanges over this one
+// process instead of forking fprocess per HTTP request.
+//
+// Every frame carries a correlation ID chosen by the watchdog. writeMu only
+// serializes the act of writing a frame, not the whole exchange, and a
+// single background reader demultiplexes responses by ID to the waiting
+// caller - so concurrent HTTP requests are pipelined onto fprocess's stdin,
+// not queued one-at-a-time behind a shared lock.
+type streamProcess struct {
+	writeMu sync.Mutex
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+
+	nextID  uint32
+	pending sync.Map // uint32 -> chan streamResult
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	closeErr  error
+}
+
+// streamResult is what the background reader delivers to a waiting
+// doStreamRequest call once its response frame arrives.
+type streamResult struct {
+	body []byte
+	err  error
+}
+
+// startStreamProcess launches fprocess once and keeps its stdin/stdout open
+// for framed exchanges for the lifetime of the watchdog.
+func startStreamProcess(config *WatchdogConfig) (*streamProcess, error) {
+	parts := strings.Split(config.faasProcess, " ")
+	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	sp := &streamProcess{
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		closed: make(chan struct{}),
+	}
+
+	go func() {
+		if waitErr := cmd.Wait(); waitErr != nil {
+			log.Printf("stream responder %s exited: %s\n", config.faasProcess, waitErr.Error())
+		}
+	}()
+
+	go sp.readLoop()
+
+	return sp, nil
+}
+
+// readLoop owns sp.stdout for the lifetime of the process: it continuously
+// reads response frames and hands each one to the pending caller with a
+// matching correlation ID. A read error means the shared pipe is no longer
+// usable, so every still-pending caller is woken with that error and the
+// process is marked closed for any future request.
+func (sp *streamProcess) readLoop() {
+	for {
+		id, body, err := readFrame(sp.stdout)
+		if err != nil {
+			sp.fail(err)
+			return
+		}
+
+		if waiter, ok := sp.pending.LoadAndDelete(id); ok {
+			waiter.(chan streamResult) <- streamResult{body: body}
+		}
+	}
+}
+
+// fail wakes every pending caller with err and marks the process closed.
+func (sp *streamProcess) fail(err error) {
+	sp.closeOnce.Do(func() {
+		sp.closeErr = err
+		close(sp.closed)
+	})
+	sp.pending.Range(func(key, value interface{}) bool {
+		sp.pending.Delete(key)
+		value.(chan streamResult) <- streamResult{err: err}
+		return true
+	})
+}
+
+// writeFrame writes one frame: a 4-byte big-endian correlation ID, a 4-byte
+// big-endian payload length, then the payload: [id][len(payload)][payload].
+func writeFrame(w io.Writer, id uint32, payload []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], id)
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFrame reads one frame written by writeFrame.
+func readFrame(r io.Reader) (uint32, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	id := binary.BigEndian.Uint32(header[0:4])
+	payload := make([]byte, binary.BigEndian.Uint32(header[4:8]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return id, payload, nil
+}
+
+// doStreamRequest sends one framed request tagged with a fresh correlation
+// ID and waits for the matching response frame, or for timeout to elapse.
+// Because each exchange has its own ID and its own wait channel, many calls
+// can be in flight at once against the same streamProcess.
+func doStreamRequest(sp *streamProcess, requestBody []byte, w http.ResponseWriter, timeout time.Duration) error {
+	select {
+	case <-sp.closed:
+		return fmt.Errorf("stream responder is no longer available: %s", sp.closeErr)
+	default:
+	}
+
+	id := atomic.AddUint32(&sp.nextID, 1)
+	resultChan := make(chan streamResult, 1)
+	sp.pending.Store(id, resultChan)
+
+	sp.writeMu.Lock()
+	writeErr := writeFrame(sp.stdin, id, requestBody)
+	sp.writeMu.Unlock()
+	if writeErr != nil {
+		sp.pending.Delete(id)
+		return fmt.Errorf("writing request frame: %s", writeErr.Error())
+	}
+
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			return fmt.Errorf("reading response frame: %s", result.err.Error())
+		}
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write(result.body)
+		return err
+	case <-timeoutChan:
+		sp.pending.Delete(id)
+		return fmt.Errorf("timed out waiting %s for a response frame", timeout)
+	}
+}
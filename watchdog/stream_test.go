@@ -0,0 +1,89 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_writeFrame_readFrame_roundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	payload := []byte("hello stream")
+
+	if err := writeFrame(&buf, 42, payload); err != nil {
+		t.Fatalf("writeFrame: %s", err)
+	}
+
+	id, got, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame: %s", err)
+	}
+	if id != 42 {
+		t.Errorf("id = %d, want 42", id)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("payload = %q, want %q", got, payload)
+	}
+}
+
+func Test_writeFrame_readFrame_empty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, 1, nil); err != nil {
+		t.Fatalf("writeFrame: %s", err)
+	}
+
+	id, got, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame: %s", err)
+	}
+	if id != 1 {
+		t.Errorf("id = %d, want 1", id)
+	}
+	if len(got) != 0 {
+		t.Errorf("payload = %q, want empty", got)
+	}
+}
+
+func Test_writeFrame_readFrame_multipleFramesPreserveOrder(t *testing.T) {
+	var buf bytes.Buffer
+	writeFrame(&buf, 1, []byte("first"))
+	writeFrame(&buf, 2, []byte("second"))
+
+	id1, body1, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame 1: %s", err)
+	}
+	id2, body2, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame 2: %s", err)
+	}
+
+	if id1 != 1 || string(body1) != "first" {
+		t.Errorf("frame 1 = (%d, %q), want (1, \"first\")", id1, body1)
+	}
+	if id2 != 2 || string(body2) != "second" {
+		t.Errorf("frame 2 = (%d, %q), want (2, \"second\")", id2, body2)
+	}
+}
+
+func Test_readFrame_truncatedHeader(t *testing.T) {
+	buf := bytes.NewReader([]byte{0, 0, 0})
+	if _, _, err := readFrame(buf); err == nil {
+		t.Fatal("expected error for truncated header, got nil")
+	}
+}
+
+func Test_readFrame_truncatedPayload(t *testing.T) {
+	var buf bytes.Buffer
+	var header [8]byte
+	// Claim a 10-byte payload but only write 2 bytes of it.
+	header[7] = 10
+	buf.Write(header[:])
+	buf.Write([]byte("ab"))
+
+	if _, _, err := readFrame(&buf); err == nil {
+		t.Fatal("expected error for truncated payload, got nil")
+	}
+}
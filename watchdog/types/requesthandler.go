@@ -0,0 +1,28 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// FunctionRequest is the JSON envelope passed to a function's stdin when
+// marshal_request is enabled, so that functions which cannot read CGI-style
+// environment variables can still access the original headers.
+type FunctionRequest struct {
+	Body   string      `json:"body"`
+	Header http.Header `json:"header"`
+}
+
+// MarshalRequest wraps the raw request body and headers into a JSON payload
+// suitable for writing to a function's stdin.
+func MarshalRequest(data []byte, header *http.Header) ([]byte, error) {
+	request := FunctionRequest{
+		Body:   string(data),
+		Header: *header,
+	}
+
+	return json.Marshal(request)
+}
@@ -0,0 +1,20 @@
+// Copyright (c) Alex Ellis 2017. All rights reserved.
+// Licensed under the MIT license. See LICENSE file in the project root for full license information.
+
+package types
+
+import "os"
+
+// HasEnv provides interface for accessing environment variables, this is used for tests
+type HasEnv interface {
+	Getenv(key string) string
+}
+
+// OsEnv implements HasEnv to get variables from the operating system
+type OsEnv struct {
+}
+
+// Getenv - wraps os.Getenv
+func (OsEnv) Getenv(key string) string {
+	return os.Getenv(key)
+}